@@ -0,0 +1,124 @@
+package kubernetes
+
+import (
+	"fmt"
+	"sync"
+)
+
+// object is implemented by every Kubernetes object type this package
+// discovers (Node, EndpointSlice, etc.), so they can be cached and looked up
+// by a single key regardless of role.
+type object interface {
+	key() string
+}
+
+// apiConfig is passed to the per-role label functions (getNodesLabels,
+// getEndpointSlicesLabels, etc.) so they can reach the objects cached by aw.
+type apiConfig struct {
+	aw *apiWatcher
+}
+
+// apiWatcher holds the objects for a single SDConfig.Role, keyed by object
+// key, and builds the LIST/WATCH API path for that role via buildListAPIPath.
+// It does not issue LIST or WATCH requests itself, and nothing in this
+// package fills objectsByKey.
+type apiWatcher struct {
+	role      string
+	namespace string
+	apiServer string
+	selectors []SelectorConfig
+
+	mu           sync.Mutex
+	objectsByKey map[string]object
+}
+
+// newAPIWatcher creates an apiWatcher for cfg.
+func newAPIWatcher(cfg *SDConfig) (*apiWatcher, error) {
+	if _, err := parsersForRole(cfg.Role); err != nil {
+		return nil, err
+	}
+	return &apiWatcher{
+		role:         cfg.Role,
+		namespace:    cfg.Namespace,
+		apiServer:    cfg.APIServer,
+		selectors:    cfg.Selectors,
+		objectsByKey: make(map[string]object),
+	}, nil
+}
+
+// getObjectsByRole returns the cached objects for role, or nil if aw is
+// watching a different role.
+func (aw *apiWatcher) getObjectsByRole(role string) []object {
+	if aw.role != role {
+		return nil
+	}
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	os := make([]object, 0, len(aw.objectsByKey))
+	for _, o := range aw.objectsByKey {
+		os = append(os, o)
+	}
+	return os
+}
+
+// roleParsers holds the List- and single-object JSON parsers for a role.
+type roleParsers struct {
+	parseList   func(data []byte) (map[string]object, ListMeta, error)
+	parseObject func(data []byte) (object, error)
+}
+
+// parsersByRole maps every supported SDConfig.Role value to its List/single-object JSON parsers.
+var parsersByRole = map[string]roleParsers{
+	"node":           {parseList: parseNodeList, parseObject: parseNode},
+	"endpointslices": {parseList: parseEndpointSliceList, parseObject: parseEndpointSlice},
+}
+
+func parsersForRole(role string) (roleParsers, error) {
+	p, ok := parsersByRole[role]
+	if !ok {
+		return roleParsers{}, fmt.Errorf("unsupported role=%q; supported roles: node, endpointslices", role)
+	}
+	return p, nil
+}
+
+// getLabelsByRole returns the discovered target labels for cfg.aw.role.
+func getLabelsByRole(cfg *apiConfig) ([]map[string]string, error) {
+	switch cfg.aw.role {
+	case "node":
+		return getNodesLabels(cfg), nil
+	case "endpointslices":
+		return getEndpointSlicesLabels(cfg), nil
+	default:
+		return nil, fmt.Errorf("unsupported role=%q; supported roles: node, endpointslices", cfg.aw.role)
+	}
+}
+
+// rolePathPrefix returns the Kubernetes API path used for LIST/WATCH requests
+// for the given role and namespace ("" for cluster-scoped roles).
+func rolePathPrefix(role, namespace string) (string, error) {
+	switch role {
+	case "node":
+		return "/api/v1/nodes", nil
+	case "endpointslices":
+		if namespace == "" {
+			return "/apis/discovery.k8s.io/v1/endpointslices", nil
+		}
+		return "/apis/discovery.k8s.io/v1/namespaces/" + namespace + "/endpointslices", nil
+	default:
+		return "", fmt.Errorf("unsupported role=%q; supported roles: node, endpointslices", role)
+	}
+}
+
+// buildListAPIPath returns the full LIST/WATCH API path for aw, including the
+// labelSelector=/fieldSelector= query params built from aw.selectors.
+func (aw *apiWatcher) buildListAPIPath() (string, error) {
+	prefix, err := rolePathPrefix(aw.role, aw.namespace)
+	if err != nil {
+		return "", err
+	}
+	path := aw.apiServer + prefix
+	if q := apiURLQuery(aw.role, aw.selectors); q != "" {
+		path += "?" + q
+	}
+	return path, nil
+}
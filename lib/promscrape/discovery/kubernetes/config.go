@@ -0,0 +1,22 @@
+package kubernetes
+
+// SDConfig is the subset of `kubernetes_sd_config` this package resolves
+// role, namespace and selector scoping from.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#kubernetes_sd_config
+type SDConfig struct {
+	APIServer string `yaml:"api_server,omitempty"`
+
+	// Role is one of the roles accepted by parsersForRole, e.g. "node" or "endpointslices".
+	Role string `yaml:"role"`
+
+	// Namespace scopes discovery to a single namespace for namespaced roles.
+	// It is ignored for cluster-scoped roles such as "node".
+	Namespace string `yaml:"namespace,omitempty"`
+
+	// Selectors scope LIST/WATCH requests for Role down to a subset of objects.
+	//
+	// See https://kubernetes.io/docs/concepts/overview/working-with-objects/label-selectors/
+	// and https://kubernetes.io/docs/concepts/overview/working-with-objects/field-selectors/
+	Selectors []SelectorConfig `yaml:"selectors,omitempty"`
+}
@@ -0,0 +1,144 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/promscrape/discoveryutils"
+)
+
+// getEndpointSlicesLabels returns labels for k8s endpointslices obtained from the given cfg
+func getEndpointSlicesLabels(cfg *apiConfig) []map[string]string {
+	epss := getEndpointSlices(cfg)
+	var ms []map[string]string
+	for _, eps := range epss {
+		ms = eps.appendTargetLabels(ms)
+	}
+	return ms
+}
+
+func getEndpointSlices(cfg *apiConfig) []*EndpointSlice {
+	os := cfg.aw.getObjectsByRole("endpointslices")
+	epss := make([]*EndpointSlice, len(os))
+	for i, o := range os {
+		epss[i] = o.(*EndpointSlice)
+	}
+	return epss
+}
+
+func (eps *EndpointSlice) key() string {
+	return eps.Metadata.key()
+}
+
+func parseEndpointSliceList(data []byte) (map[string]object, ListMeta, error) {
+	var epsl EndpointSliceList
+	if err := json.Unmarshal(data, &epsl); err != nil {
+		return nil, epsl.Metadata, fmt.Errorf("cannot unmarshal EndpointSliceList from %q: %w", data, err)
+	}
+	objectsByKey := make(map[string]object)
+	for _, eps := range epsl.Items {
+		objectsByKey[eps.key()] = eps
+	}
+	return objectsByKey, epsl.Metadata, nil
+}
+
+func parseEndpointSlice(data []byte) (object, error) {
+	var eps EndpointSlice
+	if err := json.Unmarshal(data, &eps); err != nil {
+		return nil, err
+	}
+	return &eps, nil
+}
+
+// EndpointSliceList represents EndpointSliceList from k8s API.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.21/#endpointslicelist-v1-discovery-k8s-io
+type EndpointSliceList struct {
+	Metadata ListMeta
+	Items    []*EndpointSlice
+}
+
+// EndpointSlice represents EndpointSlice from k8s API.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.21/#endpointslice-v1-discovery-k8s-io
+type EndpointSlice struct {
+	Metadata    ObjectMeta
+	Endpoints   []Endpoint
+	Ports       []EndpointPort
+	AddressType string
+}
+
+// Endpoint represents Endpoint from k8s API.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.21/#endpoint-v1-discovery-k8s-io
+type Endpoint struct {
+	Addresses  []string
+	Conditions EndpointConditions
+	Hostname   string
+	TargetRef  ObjectReference
+	Topology   map[string]string
+}
+
+// EndpointConditions represents EndpointConditions from k8s API.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.21/#endpointconditions-v1-discovery-k8s-io
+type EndpointConditions struct {
+	Ready *bool
+}
+
+func (ec *EndpointConditions) isReady() bool {
+	if ec.Ready == nil {
+		return true
+	}
+	return *ec.Ready
+}
+
+// EndpointPort represents EndpointPort from k8s API.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.21/#endpointport-v1-discovery-k8s-io
+type EndpointPort struct {
+	Name     string
+	Port     int
+	Protocol string
+}
+
+// appendTargetLabels appends labels for each ready endpoint address:port pair in eps to ms and returns the result.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#endpointslice
+func (eps *EndpointSlice) appendTargetLabels(ms []map[string]string) []map[string]string {
+	for _, ess := range eps.Endpoints {
+		if !ess.Conditions.isReady() {
+			continue
+		}
+		for _, addr := range ess.Addresses {
+			for _, port := range eps.Ports {
+				ms = append(ms, eps.appendEndpointLabels(addr, ess, port))
+			}
+		}
+	}
+	return ms
+}
+
+func (eps *EndpointSlice) appendEndpointLabels(addr string, ess Endpoint, port EndpointPort) map[string]string {
+	m := map[string]string{
+		"__address__": discoveryutils.JoinHostPort(addr, port.Port),
+		"__meta_kubernetes_endpointslice_address_type":      eps.AddressType,
+		"__meta_kubernetes_endpointslice_port_name":         port.Name,
+		"__meta_kubernetes_endpointslice_port_protocol":     port.Protocol,
+		"__meta_kubernetes_endpointslice_endpoint_hostname": ess.Hostname,
+	}
+	for k, v := range ess.Topology {
+		ln := discoveryutils.SanitizeLabelName(k)
+		m["__meta_kubernetes_endpointslice_endpoint_topology_"+ln] = v
+	}
+	if tr := ess.TargetRef; tr.Name != "" {
+		m["__meta_kubernetes_endpointslice_address_target_kind"] = tr.Kind
+		m["__meta_kubernetes_endpointslice_address_target_name"] = tr.Name
+	}
+	eps.Metadata.registerLabelsAndAnnotations("__meta_kubernetes_endpointslice", m)
+	for _, ownerRef := range eps.Metadata.OwnerReferences {
+		m["__meta_kubernetes_endpointslice_owner_kind"] = ownerRef.Kind
+		m["__meta_kubernetes_endpointslice_owner_name"] = ownerRef.Name
+	}
+	return m
+}
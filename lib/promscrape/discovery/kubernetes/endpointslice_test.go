@@ -0,0 +1,45 @@
+package kubernetes
+
+import "testing"
+
+func TestEndpointSliceAppendTargetLabels(t *testing.T) {
+	notReady := false
+	eps := &EndpointSlice{
+		Metadata:    ObjectMeta{Name: "backend-abcde"},
+		AddressType: "IPv4",
+		Ports: []EndpointPort{
+			{Name: "http", Port: 80, Protocol: "TCP"},
+		},
+		Endpoints: []Endpoint{
+			{
+				Addresses: []string{"10.0.0.1"},
+				Hostname:  "backend-0",
+				Topology:  map[string]string{"kubernetes.io/hostname": "node-1"},
+			},
+			{
+				Addresses:  []string{"10.0.0.2"},
+				Conditions: EndpointConditions{Ready: &notReady},
+			},
+		},
+	}
+
+	ms := eps.appendTargetLabels(nil)
+	if len(ms) != 1 {
+		t.Fatalf("unexpected number of target label sets; got %d; want 1 (not-ready endpoints must be skipped)", len(ms))
+	}
+
+	m := ms[0]
+	expected := map[string]string{
+		"__address__": "10.0.0.1:80",
+		"__meta_kubernetes_endpointslice_address_type":                eps.AddressType,
+		"__meta_kubernetes_endpointslice_port_name":                   "http",
+		"__meta_kubernetes_endpointslice_port_protocol":                "TCP",
+		"__meta_kubernetes_endpointslice_endpoint_hostname":            "backend-0",
+		"__meta_kubernetes_endpointslice_endpoint_topology_kubernetes_io_hostname": "node-1",
+	}
+	for k, want := range expected {
+		if got := m[k]; got != want {
+			t.Fatalf("unexpected value for label %q; got %q; want %q", k, got, want)
+		}
+	}
+}
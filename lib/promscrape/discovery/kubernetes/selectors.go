@@ -0,0 +1,48 @@
+package kubernetes
+
+import (
+	"net/url"
+	"strings"
+)
+
+// SelectorConfig represents `selectors` config for a particular role in
+// `kubernetes_sd_config`.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#kubernetes_sd_config
+type SelectorConfig struct {
+	Role  string `yaml:"role"`
+	Label string `yaml:"label"`
+	Field string `yaml:"field"`
+}
+
+// apiURLQuery returns the `labelSelector`/`fieldSelector` query string, which
+// must be appended to the LIST and WATCH urls for the given role, according
+// to selectors.
+//
+// Selectors without an explicit Role apply to every role. This is plugged
+// into the LIST/WATCH url construction in api_watcher.go.
+func apiURLQuery(role string, selectors []SelectorConfig) string {
+	var labelSelectors, fieldSelectors []string
+	for _, s := range selectors {
+		if s.Role != "" && s.Role != role {
+			continue
+		}
+		if s.Label != "" {
+			labelSelectors = append(labelSelectors, s.Label)
+		}
+		if s.Field != "" {
+			fieldSelectors = append(fieldSelectors, s.Field)
+		}
+	}
+	if len(labelSelectors) == 0 && len(fieldSelectors) == 0 {
+		return ""
+	}
+	q := make(url.Values)
+	if len(labelSelectors) > 0 {
+		q.Set("labelSelector", strings.Join(labelSelectors, ","))
+	}
+	if len(fieldSelectors) > 0 {
+		q.Set("fieldSelector", strings.Join(fieldSelectors, ","))
+	}
+	return q.Encode()
+}
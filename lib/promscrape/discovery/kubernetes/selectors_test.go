@@ -0,0 +1,60 @@
+package kubernetes
+
+import "testing"
+
+func TestApiURLQuery(t *testing.T) {
+	f := func(role string, selectors []SelectorConfig, want string) {
+		t.Helper()
+		got := apiURLQuery(role, selectors)
+		if got != want {
+			t.Fatalf("unexpected query for role=%q; got %q; want %q", role, got, want)
+		}
+	}
+
+	f("node", nil, "")
+	f("node", []SelectorConfig{{Role: "pod", Label: "app=foo"}}, "")
+	f("node", []SelectorConfig{{Label: "monitor=true"}}, "labelSelector=monitor%3Dtrue")
+	f("node", []SelectorConfig{{Field: "metadata.name=foo"}}, "fieldSelector=metadata.name%3Dfoo")
+	f("node", []SelectorConfig{
+		{Label: "monitor=true"},
+		{Role: "node", Field: "spec.unschedulable=false"},
+	}, "fieldSelector=spec.unschedulable%3Dfalse&labelSelector=monitor%3Dtrue")
+}
+
+func TestRolePathPrefix(t *testing.T) {
+	f := func(role, namespace, want string) {
+		t.Helper()
+		got, err := rolePathPrefix(role, namespace)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got != want {
+			t.Fatalf("unexpected path for role=%q, namespace=%q; got %q; want %q", role, namespace, got, want)
+		}
+	}
+
+	f("node", "", "/api/v1/nodes")
+	f("endpointslices", "", "/apis/discovery.k8s.io/v1/endpointslices")
+	f("endpointslices", "default", "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices")
+
+	if _, err := rolePathPrefix("bogus", ""); err == nil {
+		t.Fatalf("expected an error for an unsupported role")
+	}
+}
+
+func TestAPIWatcherBuildListAPIPath(t *testing.T) {
+	aw := &apiWatcher{
+		role:      "endpointslices",
+		namespace: "monitoring",
+		apiServer: "https://127.0.0.1:6443",
+		selectors: []SelectorConfig{{Label: "monitor=true"}},
+	}
+	want := "https://127.0.0.1:6443/apis/discovery.k8s.io/v1/namespaces/monitoring/endpointslices?labelSelector=monitor%3Dtrue"
+	got, err := aw.buildListAPIPath()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != want {
+		t.Fatalf("unexpected LIST/WATCH path;\ngot  %q\nwant %q", got, want)
+	}
+}
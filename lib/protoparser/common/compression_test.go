@@ -0,0 +1,63 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestZstdReaderWriter(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+
+	var buf bytes.Buffer
+	zw, err := GetZstdWriter(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error in GetZstdWriter: %s", err)
+	}
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("unexpected error when writing data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("unexpected error when closing zstd writer: %s", err)
+	}
+	PutZstdWriter(zw)
+
+	zr, err := GetZstdReader(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error in GetZstdReader: %s", err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("unexpected error when reading data: %s", err)
+	}
+	PutZstdReader(zr)
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("unexpected data; got %q; want %q", got, data)
+	}
+}
+
+func TestSnappyReaderWriter(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+
+	var buf bytes.Buffer
+	sw := GetSnappyWriter(&buf)
+	if _, err := sw.Write(data); err != nil {
+		t.Fatalf("unexpected error when writing data: %s", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("unexpected error when closing snappy writer: %s", err)
+	}
+	PutSnappyWriter(sw)
+
+	sr := GetSnappyReader(&buf)
+	got, err := io.ReadAll(sr)
+	if err != nil {
+		t.Fatalf("unexpected error when reading data: %s", err)
+	}
+	PutSnappyReader(sr)
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("unexpected data; got %q; want %q", got, data)
+	}
+}
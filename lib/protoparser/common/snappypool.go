@@ -0,0 +1,48 @@
+package common
+
+import (
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// GetSnappyReader returns snappy reader, which reads from r.
+//
+// The returned reader must be returned to the pool via PutSnappyReader when no longer needed.
+func GetSnappyReader(r io.Reader) *snappy.Reader {
+	v := snappyReaderPool.Get()
+	if v == nil {
+		return snappy.NewReader(r)
+	}
+	sr := v.(*snappy.Reader)
+	sr.Reset(r)
+	return sr
+}
+
+// PutSnappyReader returns sr to the pool, so it could be reused via GetSnappyReader.
+func PutSnappyReader(sr *snappy.Reader) {
+	snappyReaderPool.Put(sr)
+}
+
+var snappyReaderPool sync.Pool
+
+// GetSnappyWriter returns snappy writer, which writes to w.
+//
+// The returned writer must be closed and returned to the pool via PutSnappyWriter when no longer needed.
+func GetSnappyWriter(w io.Writer) *snappy.Writer {
+	v := snappyWriterPool.Get()
+	if v == nil {
+		return snappy.NewBufferedWriter(w)
+	}
+	sw := v.(*snappy.Writer)
+	sw.Reset(w)
+	return sw
+}
+
+// PutSnappyWriter returns sw to the pool, so it could be reused via GetSnappyWriter.
+func PutSnappyWriter(sw *snappy.Writer) {
+	snappyWriterPool.Put(sw)
+}
+
+var snappyWriterPool sync.Pool
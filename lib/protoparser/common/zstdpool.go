@@ -0,0 +1,50 @@
+package common
+
+import (
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// GetZstdReader returns zstd reader, which reads from r.
+//
+// The returned reader must be returned to the pool via PutZstdReader when no longer needed.
+func GetZstdReader(r io.Reader) (*zstd.Decoder, error) {
+	v := zstdReaderPool.Get()
+	if v == nil {
+		return zstd.NewReader(r)
+	}
+	zr := v.(*zstd.Decoder)
+	if err := zr.Reset(r); err != nil {
+		return nil, err
+	}
+	return zr, nil
+}
+
+// PutZstdReader returns zr to the pool, so it could be reused via GetZstdReader.
+func PutZstdReader(zr *zstd.Decoder) {
+	zstdReaderPool.Put(zr)
+}
+
+var zstdReaderPool sync.Pool
+
+// GetZstdWriter returns zstd writer, which writes to w.
+//
+// The returned writer must be closed and returned to the pool via PutZstdWriter when no longer needed.
+func GetZstdWriter(w io.Writer) (*zstd.Encoder, error) {
+	v := zstdWriterPool.Get()
+	if v == nil {
+		return zstd.NewWriter(w)
+	}
+	zw := v.(*zstd.Encoder)
+	zw.Reset(w)
+	return zw, nil
+}
+
+// PutZstdWriter returns zw to the pool, so it could be reused via GetZstdWriter.
+func PutZstdWriter(zw *zstd.Encoder) {
+	zstdWriterPool.Put(zw)
+}
+
+var zstdWriterPool sync.Pool
@@ -0,0 +1,51 @@
+package native
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/protoparser/common"
+)
+
+// WrapExportWriter wraps w so that everything written to the returned writer
+// is encoded according to acceptEncoding before reaching w, mirroring the
+// decoding side in wrapDecodingReader.
+//
+// The /api/v1/export/native HTTP handler should call WrapExportWriter with
+// the value of the request's Accept-Encoding header, set the matching
+// Content-Encoding response header and stream blocks through the returned
+// writer, closing it via the returned close function once done (which also
+// returns the writer to its pool).
+//
+// Supported values are "gzip", "zstd" and "snappy"; any other value
+// (including the empty string) returns w unchanged and a no-op close func.
+func WrapExportWriter(w io.Writer, acceptEncoding string) (io.Writer, func() error, error) {
+	switch acceptEncoding {
+	case "gzip":
+		zw := common.GetGzipWriter(w)
+		return zw, func() error {
+			err := zw.Close()
+			common.PutGzipWriter(zw)
+			return err
+		}, nil
+	case "zstd":
+		zw, err := common.GetZstdWriter(w)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot initialize zstd writer: %w", err)
+		}
+		return zw, func() error {
+			err := zw.Close()
+			common.PutZstdWriter(zw)
+			return err
+		}, nil
+	case "snappy":
+		sw := common.GetSnappyWriter(w)
+		return sw, func() error {
+			err := sw.Close()
+			common.PutSnappyWriter(sw)
+			return err
+		}, nil
+	default:
+		return w, func() error { return nil }, nil
+	}
+}
@@ -0,0 +1,521 @@
+package native
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/encoding"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/cespare/xxhash/v2"
+)
+
+// ShardRouterConfig configures a ShardRouter returned by NewShardRouter.
+type ShardRouterConfig struct {
+	// ShardAddrs is the list of `host:port` addresses of downstream ingesters
+	// blocks are fanned out to.
+	ShardAddrs []string
+
+	// HashLabels is an optional list of extra label names, whose values are
+	// mixed into the per-block routing key in addition to the metric name.
+	// This allows co-locating series sharing e.g. `job`/`instance` labels
+	// on the same shards.
+	HashLabels []string
+
+	// ReplicationFactor is the number of shards each block is written to.
+	//
+	// It is clamped to 1 if not set, and to len(ShardAddrs) if it is bigger.
+	ReplicationFactor int
+
+	// MinSuccess is the minimal number of shards a block must be successfully
+	// delivered to before it is considered written. Blocks that don't reach
+	// MinSuccess deliveries are buffered under DeadLetterDir for later replay
+	// via ReplayDeadLetterQueue.
+	//
+	// It defaults to ReplicationFactor if not set.
+	MinSuccess int
+
+	// ConnsPerShard is the number of persistent connections kept open to each
+	// shard. Workers routing to the same shard round-robin across them, so a
+	// single stuck socket (shard accepts the connection but stops reading)
+	// can't serialize every worker behind one mutex.
+	//
+	// It defaults to 4 if not set.
+	ConnsPerShard int
+
+	// DeadLetterDir is the directory where blocks that couldn't be delivered
+	// to at least MinSuccess shards are persisted. If it is empty, such
+	// blocks are reported as errors instead.
+	DeadLetterDir string
+}
+
+// ShardRouter fans out native blocks across a set of downstream ingesters
+// based on a rendezvous (HRW) hash of each block's routing key, so re-sharding
+// on scale-up only moves ~1/N of the series between shards.
+type ShardRouter struct {
+	cfg    ShardRouterConfig
+	shards []*shardConn
+	dlq    *deadLetterQueue
+}
+
+// NewShardRouter creates a ShardRouter from cfg.
+func NewShardRouter(cfg ShardRouterConfig) (*ShardRouter, error) {
+	if len(cfg.ShardAddrs) == 0 {
+		return nil, fmt.Errorf("ShardAddrs cannot be empty")
+	}
+	rf := cfg.ReplicationFactor
+	if rf <= 0 {
+		rf = 1
+	}
+	if rf > len(cfg.ShardAddrs) {
+		rf = len(cfg.ShardAddrs)
+	}
+	cfg.ReplicationFactor = rf
+	if cfg.MinSuccess <= 0 {
+		cfg.MinSuccess = cfg.ReplicationFactor
+	}
+	if cfg.MinSuccess > cfg.ReplicationFactor {
+		return nil, fmt.Errorf("MinSuccess=%d cannot exceed ReplicationFactor=%d", cfg.MinSuccess, cfg.ReplicationFactor)
+	}
+	if cfg.ConnsPerShard <= 0 {
+		cfg.ConnsPerShard = 4
+	}
+	shards := make([]*shardConn, len(cfg.ShardAddrs))
+	for i, addr := range cfg.ShardAddrs {
+		shards[i] = newShardConn(addr, cfg.ConnsPerShard)
+	}
+	var dlq *deadLetterQueue
+	if cfg.DeadLetterDir != "" {
+		d, err := newDeadLetterQueue(cfg.DeadLetterDir)
+		if err != nil {
+			return nil, fmt.Errorf("cannot initialize dead letter queue at %q: %w", cfg.DeadLetterDir, err)
+		}
+		dlq = d
+	}
+	return &ShardRouter{
+		cfg:    cfg,
+		shards: shards,
+		dlq:    dlq,
+	}, nil
+}
+
+// ParseStreamToShards reads an /api/v1/import/native request body from req
+// and routes every block to router, re-framing the raw metricName+block bytes
+// in the native wire format on the way out without decoding samples.
+//
+// req.Body can be compressed with gzip, zstd or snappy, same as for ParseStream.
+func ParseStreamToShards(req *http.Request, router *ShardRouter) error {
+	r, putReader, err := wrapDecodingReader(req)
+	if err != nil {
+		return err
+	}
+	defer putReader()
+	br := bufio.NewReaderSize(r, 1024*1024)
+
+	if _, err := readTimeRange(br); err != nil {
+		return err
+	}
+
+	gomaxprocs := runtime.GOMAXPROCS(-1)
+	workCh := make(chan *unmarshalWork, 8*gomaxprocs)
+	var wg sync.WaitGroup
+	defer func() {
+		close(workCh)
+		wg.Wait()
+	}()
+	wg.Add(gomaxprocs)
+	for i := 0; i < gomaxprocs; i++ {
+		go func() {
+			defer wg.Done()
+			for uw := range workCh {
+				if err := router.route(uw.metricNameBuf, uw.blockBuf); err != nil {
+					routeErrors.Inc()
+					logger.Errorf("error when routing native block: %s", err)
+				}
+				putUnmarshalWork(uw)
+			}
+		}()
+	}
+
+	return readBlocks(br, workCh, 1024*1024, 1024*1024)
+}
+
+// route hashes metricNameBuf to pick cfg.ReplicationFactor shards and writes
+// the (metricNameBuf, blockBuf) frame to each of them, falling back to the
+// dead letter queue if fewer than cfg.MinSuccess deliveries succeed.
+func (r *ShardRouter) route(metricNameBuf, blockBuf []byte) error {
+	var mn storage.MetricName
+	if err := mn.UnmarshalNoAccountIDProjectID(metricNameBuf); err != nil {
+		return fmt.Errorf("cannot unmarshal metricName for routing from %d bytes: %w", len(metricNameBuf), err)
+	}
+	key := routingKey(nil, &mn, r.cfg.HashLabels)
+	shards := r.selectShards(key)
+
+	frame := frameBlock(metricNameBuf, blockBuf)
+	successes := 0
+	for _, sc := range shards {
+		if err := sc.send(frame); err != nil {
+			logger.Warnf("cannot deliver native block to shard %q: %s", sc.addr, err)
+			continue
+		}
+		successes++
+	}
+	blocksRouted.Inc()
+	if successes >= r.cfg.MinSuccess {
+		return nil
+	}
+	dlqBlocks.Inc()
+	if r.dlq == nil {
+		return fmt.Errorf("block was delivered to only %d of %d required shards and DeadLetterDir isn't configured", successes, r.cfg.MinSuccess)
+	}
+	return r.dlq.write(metricNameBuf, blockBuf)
+}
+
+// selectShards returns cfg.ReplicationFactor shards for the given routing key
+// using rendezvous (highest random weight) hashing, so adding or removing a
+// shard only reshuffles ~1/N of the keys.
+func (r *ShardRouter) selectShards(key []byte) []*shardConn {
+	type scoredShard struct {
+		sc    *shardConn
+		score uint64
+	}
+	scored := make([]scoredShard, len(r.shards))
+	for i, sc := range r.shards {
+		h := xxhash.New()
+		h.Write(key)
+		h.Write([]byte(sc.addr))
+		scored[i] = scoredShard{sc: sc, score: h.Sum64()}
+	}
+	sort.Slice(scored, func(i, j int) bool {
+		return scored[i].score > scored[j].score
+	})
+	result := make([]*shardConn, r.cfg.ReplicationFactor)
+	for i := range result {
+		result[i] = scored[i].sc
+	}
+	return result
+}
+
+// routingKey appends the routing key for mn to dst and returns the result.
+//
+// The key is derived from the metric name and the values of hashLabels, so
+// series sharing those labels are routed to the same shards.
+func routingKey(dst []byte, mn *storage.MetricName, hashLabels []string) []byte {
+	dst = append(dst, mn.MetricGroup...)
+	for _, name := range hashLabels {
+		dst = append(dst, 0)
+		dst = append(dst, name...)
+		dst = append(dst, '=')
+		dst = append(dst, mn.GetTagValue(name)...)
+	}
+	return dst
+}
+
+// frameBlock re-frames metricNameBuf and blockBuf in the native wire format
+// (size-prefixed metricName followed by size-prefixed block), the same format
+// ParseStream and ParseStreamToShards read from the request body.
+func frameBlock(metricNameBuf, blockBuf []byte) []byte {
+	buf := make([]byte, 0, 4+len(metricNameBuf)+4+len(blockBuf))
+	buf = encoding.MarshalUint32(buf, uint32(len(metricNameBuf)))
+	buf = append(buf, metricNameBuf...)
+	buf = encoding.MarshalUint32(buf, uint32(len(blockBuf)))
+	buf = append(buf, blockBuf...)
+	return buf
+}
+
+// shardWriteTimeout bounds how long shardConn.send may block writing a frame
+// to a shard's socket. Without it, a shard that accepts the connection but
+// stops reading (paused, GC stall, backpressure - not a hard "down" the dial
+// timeout catches) would block the write forever while holding the
+// connection's lock, wedging every worker that hashes to that shard.
+const shardWriteTimeout = 5 * time.Second
+
+// shardConn is a small pool of persistent connections to a single downstream
+// ingester shard. Workers round-robin across the pool so that one slow or
+// stuck socket doesn't serialize every worker routing to this shard behind a
+// single mutex.
+type shardConn struct {
+	addr  string
+	conns []*pooledConn
+	next  uint64 // accessed atomically, round-robins across conns
+}
+
+func newShardConn(addr string, n int) *shardConn {
+	conns := make([]*pooledConn, n)
+	for i := range conns {
+		conns[i] = &pooledConn{}
+	}
+	return &shardConn{addr: addr, conns: conns}
+}
+
+func (sc *shardConn) send(frame []byte) error {
+	i := atomic.AddUint64(&sc.next, 1)
+	pc := sc.conns[i%uint64(len(sc.conns))]
+	return pc.send(sc.addr, frame)
+}
+
+// pooledConn is a single lazily-dialed connection within a shardConn's pool.
+type pooledConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (pc *pooledConn) send(addr string, frame []byte) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.conn == nil {
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			return fmt.Errorf("cannot connect to shard %q: %w", addr, err)
+		}
+		pc.conn = conn
+	}
+	if err := pc.conn.SetWriteDeadline(time.Now().Add(shardWriteTimeout)); err != nil {
+		pc.conn.Close()
+		pc.conn = nil
+		return fmt.Errorf("cannot set write deadline for shard %q: %w", addr, err)
+	}
+	if _, err := pc.conn.Write(frame); err != nil {
+		pc.conn.Close()
+		pc.conn = nil
+		return fmt.Errorf("cannot write block to shard %q (possibly timed out after %s): %w", addr, shardWriteTimeout, err)
+	}
+	return nil
+}
+
+// dlqTmpSuffix marks a dead-letter file that is still open for append by a
+// live deadLetterQueue. ReplayDeadLetterQueue skips such files, since a file
+// still being written to can be read mid-append and yield a torn final frame.
+const dlqTmpSuffix = ".tmp"
+
+// dlqMaxFileSize and dlqMaxFileAge bound how long a dead-letter file stays
+// open for append before it is sealed (closed and renamed without
+// dlqTmpSuffix) and a new one is opened in its place, so ReplayDeadLetterQueue
+// always has something safe to replay instead of waiting on one huge file.
+const (
+	dlqMaxFileSize = 32 * 1024 * 1024
+	dlqMaxFileAge  = 5 * time.Minute
+)
+
+// deadLetterQueue persists blocks that couldn't be delivered to enough shards,
+// so they can be replayed later via ReplayDeadLetterQueue.
+type deadLetterQueue struct {
+	dir string
+
+	mu       sync.Mutex
+	file     *os.File
+	path     string
+	size     int64
+	openedAt time.Time
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newDeadLetterQueue(dir string) (*deadLetterQueue, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("cannot create dead letter queue directory: %w", err)
+	}
+	dlq := &deadLetterQueue{
+		dir:    dir,
+		stopCh: make(chan struct{}),
+	}
+	dlq.wg.Add(1)
+	go dlq.sealStaleFileLoop()
+	return dlq, nil
+}
+
+// sealStaleFileLoop periodically seals the currently open dead-letter file
+// once it crosses dlqMaxFileAge, even if no further blocks are written to it.
+// Without this, a shard outage that stops producing new dead-letter blocks
+// (or an idle coordinator) would leave the file under dlqTmpSuffix forever,
+// invisible to ReplayDeadLetterQueue, until the process happens to restart
+// and call ShardRouter.Close.
+func (dlq *deadLetterQueue) sealStaleFileLoop() {
+	defer dlq.wg.Done()
+	t := time.NewTicker(dlqMaxFileAge / 5)
+	defer t.Stop()
+	for {
+		select {
+		case <-dlq.stopCh:
+			return
+		case <-t.C:
+			dlq.mu.Lock()
+			if dlq.file != nil && time.Since(dlq.openedAt) >= dlqMaxFileAge {
+				if err := dlq.sealLocked(); err != nil {
+					logger.Errorf("cannot seal stale dead letter queue file: %s", err)
+				}
+			}
+			dlq.mu.Unlock()
+		}
+	}
+}
+
+// stop terminates sealStaleFileLoop. It must be called before dlq is
+// discarded, so the goroutine it spawned doesn't leak.
+func (dlq *deadLetterQueue) stop() {
+	close(dlq.stopCh)
+	dlq.wg.Wait()
+}
+
+func (dlq *deadLetterQueue) write(metricNameBuf, blockBuf []byte) error {
+	dlq.mu.Lock()
+	defer dlq.mu.Unlock()
+	if dlq.file != nil && (dlq.size >= dlqMaxFileSize || time.Since(dlq.openedAt) >= dlqMaxFileAge) {
+		if err := dlq.sealLocked(); err != nil {
+			return err
+		}
+	}
+	if dlq.file == nil {
+		if err := dlq.openLocked(); err != nil {
+			return err
+		}
+	}
+	frame := frameBlock(metricNameBuf, blockBuf)
+	n, err := dlq.file.Write(frame)
+	if err != nil {
+		return fmt.Errorf("cannot write block to dead letter queue file %q: %w", dlq.path, err)
+	}
+	dlq.size += int64(n)
+	return nil
+}
+
+// openLocked opens a new dead-letter file with dlqTmpSuffix, so
+// ReplayDeadLetterQueue knows to leave it alone until it is sealed.
+//
+// It must be called with dlq.mu held.
+func (dlq *deadLetterQueue) openLocked() error {
+	path := filepath.Join(dlq.dir, fmt.Sprintf("dlq-%d.bin%s", time.Now().UnixNano(), dlqTmpSuffix))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("cannot open dead letter queue file: %w", err)
+	}
+	dlq.file = f
+	dlq.path = path
+	dlq.size = 0
+	dlq.openedAt = time.Now()
+	return nil
+}
+
+// seal closes and seals the currently open dead-letter file, if any, so it
+// becomes eligible for ReplayDeadLetterQueue.
+func (dlq *deadLetterQueue) seal() error {
+	dlq.mu.Lock()
+	defer dlq.mu.Unlock()
+	return dlq.sealLocked()
+}
+
+// sealLocked must be called with dlq.mu held.
+func (dlq *deadLetterQueue) sealLocked() error {
+	if dlq.file == nil {
+		return nil
+	}
+	if err := dlq.file.Close(); err != nil {
+		return fmt.Errorf("cannot close dead letter queue file %q: %w", dlq.path, err)
+	}
+	sealedPath := strings.TrimSuffix(dlq.path, dlqTmpSuffix)
+	if err := os.Rename(dlq.path, sealedPath); err != nil {
+		return fmt.Errorf("cannot seal dead letter queue file %q: %w", dlq.path, err)
+	}
+	dlq.file = nil
+	dlq.path = ""
+	dlq.size = 0
+	return nil
+}
+
+// Close stops the dead letter queue's background seal loop and seals its
+// currently open file, if any, making it eligible for ReplayDeadLetterQueue.
+// It should be called when router is being shut down.
+func (r *ShardRouter) Close() error {
+	if r.dlq == nil {
+		return nil
+	}
+	r.dlq.stop()
+	return r.dlq.seal()
+}
+
+// ReplayDeadLetterQueue reads every sealed dead-letter file under dir and
+// re-submits its blocks to router, removing files that were fully replayed.
+// Files still open for append by a live deadLetterQueue (suffixed with
+// dlqTmpSuffix) are left untouched; a live deadLetterQueue seals its open
+// file on its own once it crosses dlqMaxFileAge, so it never sits unsealed
+// indefinitely just because it stopped receiving new blocks.
+//
+// It is intended to be run out-of-band, e.g. once previously unreachable
+// shards are back up, possibly while router is still live and writing new
+// dead-letter files.
+func ReplayDeadLetterQueue(dir string, router *ShardRouter) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("cannot list dead letter queue directory %q: %w", dir, err)
+	}
+	for _, e := range entries {
+		if e.IsDir() || strings.HasSuffix(e.Name(), dlqTmpSuffix) {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		if err := replayDeadLetterFile(path, router); err != nil {
+			return fmt.Errorf("cannot replay dead letter queue file %q: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func replayDeadLetterFile(path string, router *ShardRouter) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	sizeBuf := make([]byte, 4)
+	for {
+		metricNameBuf, blockBuf, err := readFrame(br, sizeBuf)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if err := router.route(metricNameBuf, blockBuf); err != nil {
+			return fmt.Errorf("cannot re-route block: %w", err)
+		}
+	}
+	return os.Remove(path)
+}
+
+func readFrame(br *bufio.Reader, sizeBuf []byte) (metricNameBuf, blockBuf []byte, err error) {
+	if _, err := io.ReadFull(br, sizeBuf); err != nil {
+		return nil, nil, err
+	}
+	metricNameBuf = make([]byte, encoding.UnmarshalUint32(sizeBuf))
+	if _, err := io.ReadFull(br, metricNameBuf); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(br, sizeBuf); err != nil {
+		return nil, nil, err
+	}
+	blockBuf = make([]byte, encoding.UnmarshalUint32(sizeBuf))
+	if _, err := io.ReadFull(br, blockBuf); err != nil {
+		return nil, nil, err
+	}
+	return metricNameBuf, blockBuf, nil
+}
+
+var (
+	blocksRouted = metrics.NewCounter(`vm_protoparser_blocks_routed_total{type="native"}`)
+	routeErrors  = metrics.NewCounter(`vm_protoparser_route_errors_total{type="native"}`)
+	dlqBlocks    = metrics.NewCounter(`vm_protoparser_dlq_blocks_total{type="native"}`)
+)
@@ -0,0 +1,243 @@
+package native
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+// marshaledMetricName returns the wire-format bytes for a MetricName with the
+// given metric name, as route() expects to unmarshal from metricNameBuf.
+func marshaledMetricName(t *testing.T, name string) []byte {
+	t.Helper()
+	mn := storage.MetricName{MetricGroup: []byte(name)}
+	return mn.MarshalNoAccountIDProjectID(nil)
+}
+
+func TestShardRouterSelectShardsIsDeterministic(t *testing.T) {
+	r, err := NewShardRouter(ShardRouterConfig{
+		ShardAddrs:        []string{"s0:8400", "s1:8400", "s2:8400", "s3:8400"},
+		ReplicationFactor: 2,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	key := []byte("tenant=1,__name__=cpu_usage")
+	got1 := r.selectShards(key)
+	got2 := r.selectShards(key)
+	if len(got1) != 2 || len(got2) != 2 {
+		t.Fatalf("unexpected number of selected shards: %d and %d", len(got1), len(got2))
+	}
+	for i := range got1 {
+		if got1[i] != got2[i] {
+			t.Fatalf("selectShards must return the same shards for the same key")
+		}
+	}
+}
+
+func TestShardRouterSelectShardsStableOnScaleUp(t *testing.T) {
+	before, err := NewShardRouter(ShardRouterConfig{
+		ShardAddrs:        []string{"s0:8400", "s1:8400", "s2:8400", "s3:8400"},
+		ReplicationFactor: 1,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	after, err := NewShardRouter(ShardRouterConfig{
+		ShardAddrs:        []string{"s0:8400", "s1:8400", "s2:8400", "s3:8400", "s4:8400"},
+		ReplicationFactor: 1,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	const numKeys = 1000
+	moved := 0
+	for i := 0; i < numKeys; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		b := before.selectShards(key)[0].addr
+		a := after.selectShards(key)[0].addr
+		if b != a {
+			moved++
+		}
+	}
+	// Adding one shard to four should reshuffle about 1/5 of the keys;
+	// assert it stays well below a full reshuffle.
+	if moved > numKeys/3 {
+		t.Fatalf("too many keys moved on scale-up: %d out of %d", moved, numKeys)
+	}
+}
+
+func TestDeadLetterQueueSeal(t *testing.T) {
+	dir := t.TempDir()
+	dlq, err := newDeadLetterQueue(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	t.Cleanup(dlq.stop)
+
+	if err := dlq.write([]byte("metric-name"), []byte("block")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(entries) != 1 || !strings.HasSuffix(entries[0].Name(), dlqTmpSuffix) {
+		t.Fatalf("expected a single in-progress dead-letter file, got %v", entries)
+	}
+
+	if err := dlq.seal(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	entries, err = os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(entries) != 1 || strings.HasSuffix(entries[0].Name(), dlqTmpSuffix) {
+		t.Fatalf("expected a single sealed dead-letter file, got %v", entries)
+	}
+
+	// Sealing again with nothing open must be a no-op.
+	if err := dlq.seal(); err != nil {
+		t.Fatalf("unexpected error sealing an already-sealed queue: %s", err)
+	}
+}
+
+// startFakeShard starts a TCP listener that accepts connections and discards
+// whatever is written to them, simulating a healthy downstream shard.
+func startFakeShard(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot start fake shard listener: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// unreachableAddr returns an address nothing listens on, so dialing it fails
+// immediately with "connection refused" instead of hanging, simulating a shard
+// that is down.
+func unreachableAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot allocate an address: %s", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestShardRouterRouteReachesMinSuccessWithoutDeadLetter(t *testing.T) {
+	good1 := startFakeShard(t)
+	good2 := startFakeShard(t)
+	down := unreachableAddr(t)
+	dir := t.TempDir()
+
+	r, err := NewShardRouter(ShardRouterConfig{
+		ShardAddrs:        []string{good1, good2, down},
+		ReplicationFactor: 3,
+		MinSuccess:        2,
+		DeadLetterDir:     dir,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := r.route(marshaledMetricName(t, "metric-name"), []byte("block")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("block reached MinSuccess deliveries and must not be dead-lettered, got files: %v", entries)
+	}
+}
+
+func TestShardRouterRouteFallsBackToDeadLetterBelowMinSuccess(t *testing.T) {
+	good := startFakeShard(t)
+	down1 := unreachableAddr(t)
+	down2 := unreachableAddr(t)
+	dir := t.TempDir()
+
+	r, err := NewShardRouter(ShardRouterConfig{
+		ShardAddrs:        []string{good, down1, down2},
+		ReplicationFactor: 3,
+		MinSuccess:        2,
+		DeadLetterDir:     dir,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	metricNameBuf := marshaledMetricName(t, "metric-name")
+	if err := r.route(metricNameBuf, []byte("block-data")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("block that only reached 1 of MinSuccess=2 deliveries must be dead-lettered, got files: %v", entries)
+	}
+
+	f, err := os.Open(dir + "/" + entries[0].Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	sizeBuf := make([]byte, 4)
+	gotMetricNameBuf, gotBlockBuf, err := readFrame(br, sizeBuf)
+	if err != nil {
+		t.Fatalf("unexpected error reading dead-lettered frame: %s", err)
+	}
+	if string(gotMetricNameBuf) != string(metricNameBuf) || string(gotBlockBuf) != "block-data" {
+		t.Fatalf("unexpected dead-lettered frame: metricName=%q block=%q", gotMetricNameBuf, gotBlockBuf)
+	}
+}
+
+func TestShardRouterRouteWithoutDeadLetterDirReturnsError(t *testing.T) {
+	down1 := unreachableAddr(t)
+	down2 := unreachableAddr(t)
+
+	r, err := NewShardRouter(ShardRouterConfig{
+		ShardAddrs:        []string{down1, down2},
+		ReplicationFactor: 2,
+		MinSuccess:        1,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := r.route(marshaledMetricName(t, "metric-name"), []byte("block")); err == nil {
+		t.Fatalf("expected an error when no shards are reachable and DeadLetterDir isn't configured")
+	}
+}
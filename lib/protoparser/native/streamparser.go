@@ -18,33 +18,100 @@ import (
 
 // ParseStream parses /api/v1/import/native lines from req and calls callback for parsed blocks.
 //
+// req.Body can be compressed with gzip, zstd or snappy. The correspondent Content-Encoding
+// header must be set on req in this case.
+//
 // The callback can be called multiple times for streamed data from req.
 //
 // callback shouldn't hold block after returning.
 // callback can be called in parallel from multiple concurrent goroutines.
 func ParseStream(req *http.Request, callback func(block *Block) error) error {
-	r := req.Body
-	if req.Header.Get("Content-Encoding") == "gzip" {
-		zr, err := common.GetGzipReader(r)
-		if err != nil {
-			return fmt.Errorf("cannot read gzipped vmimport data: %w", err)
-		}
-		defer common.PutGzipReader(zr)
-		r = zr
+	return ParseStreamWithOptions(req, nil, callback)
+}
+
+// ParseStreamOptions customizes ParseStreamWithOptions behavior.
+type ParseStreamOptions struct {
+	// MaxMetricNameSize limits the size of a single metricName frame.
+	//
+	// The default limit of 1MB is used if MaxMetricNameSize isn't set.
+	MaxMetricNameSize int
+
+	// MaxBlockSize limits the size of a single native block frame.
+	//
+	// The default limit of 1MB is used if MaxBlockSize isn't set.
+	MaxBlockSize int
+
+	// Validate is called for every successfully unmarshaled block before
+	// it is passed to the ParseStreamWithOptions callback. This allows
+	// enforcing label cardinality, name regexes or tenant quotas without
+	// wrapping the callback.
+	//
+	// Blocks failing validation are passed to Quarantine, if set, instead of
+	// reaching callback; without Quarantine they are dropped.
+	Validate func(block *Block) error
+
+	// Quarantine, if set, receives a copy of the raw metricNameBuf and
+	// blockBuf bytes of every block that fails to unmarshal or fails
+	// Validate, together with the error that caused it to be dropped. This
+	// allows persisting bad blocks for offline inspection instead of losing
+	// them to a log line.
+	//
+	// The slices passed to Quarantine are freshly allocated copies owned by
+	// the caller: unlike Block passed to the ParseStreamWithOptions
+	// callback, Quarantine is free to retain them past its return, e.g. to
+	// queue them for async disk I/O, without racing unmarshalWork reuse.
+	//
+	// Quarantine can be called in parallel from multiple concurrent goroutines.
+	Quarantine func(metricNameBuf, blockBuf []byte, err error)
+}
+
+func (opts *ParseStreamOptions) maxMetricNameSize() int {
+	if opts == nil || opts.MaxMetricNameSize <= 0 {
+		return 1024 * 1024
+	}
+	return opts.MaxMetricNameSize
+}
+
+func (opts *ParseStreamOptions) maxBlockSize() int {
+	if opts == nil || opts.MaxBlockSize <= 0 {
+		return 1024 * 1024
 	}
+	return opts.MaxBlockSize
+}
+
+// quarantine invokes opts.Quarantine, if set, with copies of uw's buffers.
+//
+// uw is returned to unmarshalWorkPool by the caller right after this call,
+// and a subsequent getUnmarshalWork() can reuse the same backing arrays and
+// overwrite them in place, so Quarantine must never be handed uw's buffers
+// directly.
+func (opts *ParseStreamOptions) quarantine(uw *unmarshalWork, err error) {
+	if opts == nil || opts.Quarantine == nil {
+		return
+	}
+	metricNameBuf := append([]byte{}, uw.metricNameBuf...)
+	blockBuf := append([]byte{}, uw.blockBuf...)
+	opts.Quarantine(metricNameBuf, blockBuf, err)
+}
+
+// ParseStreamWithOptions works the same as ParseStream, but allows customizing
+// size limits plus per-block validation and quarantine of bad blocks via opts.
+//
+// opts may be nil; in this case ParseStreamWithOptions behaves exactly like ParseStream.
+func ParseStreamWithOptions(req *http.Request, opts *ParseStreamOptions, callback func(block *Block) error) error {
+	r, putReader, err := wrapDecodingReader(req)
+	if err != nil {
+		return err
+	}
+	defer putReader()
 	// By default req.Body uses 4Kb buffer. This size is too small for typical request to /api/v1/import/native,
 	// so use slightly bigger buffer in order to reduce read syscall overhead.
 	br := bufio.NewReaderSize(r, 1024*1024)
 
-	// Read time range (tr)
-	trBuf := make([]byte, 16)
-	var tr storage.TimeRange
-	if _, err := io.ReadFull(br, trBuf); err != nil {
-		readErrors.Inc()
-		return fmt.Errorf("cannot read time range: %w", err)
+	tr, err := readTimeRange(br)
+	if err != nil {
+		return err
 	}
-	tr.MinTimestamp = encoding.UnmarshalInt64(trBuf)
-	tr.MaxTimestamp = encoding.UnmarshalInt64(trBuf[8:])
 
 	// Start GOMAXPROC workers in order to process ingested data in parallel.
 	gomaxprocs := runtime.GOMAXPROCS(-1)
@@ -63,9 +130,18 @@ func ParseStream(req *http.Request, callback func(block *Block) error) error {
 				if err := uw.unmarshal(&tmpBlock, tr); err != nil {
 					parseErrors.Inc()
 					logger.Errorf("error when unmarshaling native block: %s", err)
+					opts.quarantine(uw, err)
 					putUnmarshalWork(uw)
 					continue
 				}
+				if opts != nil && opts.Validate != nil {
+					if err := opts.Validate(&uw.block); err != nil {
+						validateErrors.Inc()
+						opts.quarantine(uw, err)
+						putUnmarshalWork(uw)
+						continue
+					}
+				}
 				if err := callback(&uw.block); err != nil {
 					processErrors.Inc()
 					logger.Errorf("error when processing native block: %s", err)
@@ -77,13 +153,61 @@ func ParseStream(req *http.Request, callback func(block *Block) error) error {
 		}()
 	}
 
-	// Read native blocks and feed workers with work.
+	return readBlocks(br, workCh, opts.maxMetricNameSize(), opts.maxBlockSize())
+}
+
+// wrapDecodingReader wraps req.Body according to its Content-Encoding header
+// and returns the decoded reader together with a function that must be
+// deferred by the caller in order to return pooled decoders back to their pools.
+func wrapDecodingReader(req *http.Request) (io.Reader, func(), error) {
+	r := io.Reader(req.Body)
+	switch req.Header.Get("Content-Encoding") {
+	case "gzip":
+		zr, err := common.GetGzipReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read gzipped vmimport data: %w", err)
+		}
+		return zr, func() { common.PutGzipReader(zr) }, nil
+	case "zstd":
+		zr, err := common.GetZstdReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read zstd-compressed vmimport data: %w", err)
+		}
+		return zr, func() { common.PutZstdReader(zr) }, nil
+	case "snappy":
+		sr := common.GetSnappyReader(r)
+		return sr, func() { common.PutSnappyReader(sr) }, nil
+	default:
+		return r, func() {}, nil
+	}
+}
+
+// readTimeRange reads the time range (tr) vmimport native requests are prefixed with.
+func readTimeRange(br *bufio.Reader) (storage.TimeRange, error) {
+	var tr storage.TimeRange
+	trBuf := make([]byte, 16)
+	if _, err := io.ReadFull(br, trBuf); err != nil {
+		readErrors.Inc()
+		return tr, fmt.Errorf("cannot read time range: %w", err)
+	}
+	tr.MinTimestamp = encoding.UnmarshalInt64(trBuf)
+	tr.MaxTimestamp = encoding.UnmarshalInt64(trBuf[8:])
+	return tr, nil
+}
+
+// readBlocks reads size-prefixed metricName+block frames from br and sends
+// the corresponding pooled unmarshalWork to workCh for processing. It returns
+// nil when br is exhausted.
+//
+// maxMetricNameSize and maxBlockSize cap the accepted frame sizes.
+func readBlocks(br *bufio.Reader, workCh chan<- *unmarshalWork, maxMetricNameSize, maxBlockSize int) error {
 	sizeBuf := make([]byte, 4)
 	for {
 		uw := getUnmarshalWork()
 
 		// Read uw.metricNameBuf
 		if _, err := io.ReadFull(br, sizeBuf); err != nil {
+			putUnmarshalWork(uw)
 			if err == io.EOF {
 				// End of stream
 				return nil
@@ -93,13 +217,15 @@ func ParseStream(req *http.Request, callback func(block *Block) error) error {
 		}
 		readCalls.Inc()
 		bufSize := encoding.UnmarshalUint32(sizeBuf)
-		if bufSize > 1024*1024 {
+		if bufSize > uint32(maxMetricNameSize) {
 			parseErrors.Inc()
-			return fmt.Errorf("too big metricName size; got %d; shouldn't exceed %d", bufSize, 1024*1024)
+			putUnmarshalWork(uw)
+			return fmt.Errorf("too big metricName size; got %d; shouldn't exceed %d", bufSize, maxMetricNameSize)
 		}
 		uw.metricNameBuf = bytesutil.Resize(uw.metricNameBuf, int(bufSize))
 		if _, err := io.ReadFull(br, uw.metricNameBuf); err != nil {
 			readErrors.Inc()
+			putUnmarshalWork(uw)
 			return fmt.Errorf("cannot read metricName with size %d bytes: %w", bufSize, err)
 		}
 		readCalls.Inc()
@@ -107,17 +233,20 @@ func ParseStream(req *http.Request, callback func(block *Block) error) error {
 		// Read uw.blockBuf
 		if _, err := io.ReadFull(br, sizeBuf); err != nil {
 			readErrors.Inc()
+			putUnmarshalWork(uw)
 			return fmt.Errorf("cannot read native block size: %w", err)
 		}
 		readCalls.Inc()
 		bufSize = encoding.UnmarshalUint32(sizeBuf)
-		if bufSize > 1024*1024 {
+		if bufSize > uint32(maxBlockSize) {
 			parseErrors.Inc()
-			return fmt.Errorf("too big native block size; got %d; shouldn't exceed %d", bufSize, 1024*1024)
+			putUnmarshalWork(uw)
+			return fmt.Errorf("too big native block size; got %d; shouldn't exceed %d", bufSize, maxBlockSize)
 		}
 		uw.blockBuf = bytesutil.Resize(uw.blockBuf, int(bufSize))
 		if _, err := io.ReadFull(br, uw.blockBuf); err != nil {
 			readErrors.Inc()
+			putUnmarshalWork(uw)
 			return fmt.Errorf("cannot read native block with size %d bytes: %w", bufSize, err)
 		}
 		readCalls.Inc()
@@ -147,8 +276,9 @@ var (
 	rowsRead   = metrics.NewCounter(`vm_protoparser_rows_read_total{type="native"}`)
 	blocksRead = metrics.NewCounter(`vm_protoparser_blocks_read_total{type="native"}`)
 
-	parseErrors   = metrics.NewCounter(`vm_protoparser_parse_errors_total{type="native"}`)
-	processErrors = metrics.NewCounter(`vm_protoparser_process_errors_total{type="native"}`)
+	parseErrors    = metrics.NewCounter(`vm_protoparser_parse_errors_total{type="native"}`)
+	processErrors  = metrics.NewCounter(`vm_protoparser_process_errors_total{type="native"}`)
+	validateErrors = metrics.NewCounter(`vm_protoparser_validate_errors_total{type="native"}`)
 )
 
 type unmarshalWork struct {
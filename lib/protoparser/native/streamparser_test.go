@@ -0,0 +1,94 @@
+package native
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/encoding"
+)
+
+func TestParseStreamOptionsDefaults(t *testing.T) {
+	var opts *ParseStreamOptions
+	if got := opts.maxMetricNameSize(); got != 1024*1024 {
+		t.Fatalf("unexpected default MaxMetricNameSize: %d", got)
+	}
+	if got := opts.maxBlockSize(); got != 1024*1024 {
+		t.Fatalf("unexpected default MaxBlockSize: %d", got)
+	}
+
+	opts = &ParseStreamOptions{MaxMetricNameSize: 42, MaxBlockSize: 43}
+	if got := opts.maxMetricNameSize(); got != 42 {
+		t.Fatalf("unexpected overridden MaxMetricNameSize: %d", got)
+	}
+	if got := opts.maxBlockSize(); got != 43 {
+		t.Fatalf("unexpected overridden MaxBlockSize: %d", got)
+	}
+}
+
+func TestParseStreamOptionsQuarantineCopiesBuffers(t *testing.T) {
+	uw := &unmarshalWork{
+		metricNameBuf: []byte("metric-name"),
+		blockBuf:      []byte("block-data"),
+	}
+	var gotName, gotBlock []byte
+	opts := &ParseStreamOptions{
+		Quarantine: func(metricNameBuf, blockBuf []byte, err error) {
+			gotName = metricNameBuf
+			gotBlock = blockBuf
+		},
+	}
+	opts.quarantine(uw, fmt.Errorf("boom"))
+
+	// Mutate uw's buffers in place, mirroring what putUnmarshalWork followed
+	// by a subsequent getUnmarshalWork()+readBlocks() resize-and-overwrite
+	// would do to the same backing array.
+	copy(uw.metricNameBuf, []byte("xxxxxxxxxxx"))
+	copy(uw.blockBuf, []byte("yyyyyyyyyy"))
+
+	if string(gotName) != "metric-name" {
+		t.Fatalf("Quarantine's metricNameBuf was corrupted by unmarshalWork reuse: got %q", gotName)
+	}
+	if string(gotBlock) != "block-data" {
+		t.Fatalf("Quarantine's blockBuf was corrupted by unmarshalWork reuse: got %q", gotBlock)
+	}
+}
+
+func TestParseStreamOptionsQuarantineNoop(t *testing.T) {
+	uw := &unmarshalWork{metricNameBuf: []byte("m"), blockBuf: []byte("b")}
+
+	var opts *ParseStreamOptions
+	opts.quarantine(uw, fmt.Errorf("boom")) // must not panic when opts is nil
+
+	opts = &ParseStreamOptions{}
+	opts.quarantine(uw, fmt.Errorf("boom")) // must not panic when Quarantine isn't set
+}
+
+func TestReadBlocksRejectsOversizedMetricName(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(encoding.MarshalUint32(nil, 100))
+	buf.Write(make([]byte, 100))
+
+	br := bufio.NewReader(&buf)
+	workCh := make(chan *unmarshalWork, 1)
+	err := readBlocks(br, workCh, 10, 1024*1024)
+	if err == nil {
+		t.Fatalf("expected an error for a metricName frame bigger than maxMetricNameSize")
+	}
+}
+
+func TestReadBlocksRejectsOversizedBlock(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(encoding.MarshalUint32(nil, 3))
+	buf.WriteString("abc")
+	buf.Write(encoding.MarshalUint32(nil, 100))
+	buf.Write(make([]byte, 100))
+
+	br := bufio.NewReader(&buf)
+	workCh := make(chan *unmarshalWork, 1)
+	err := readBlocks(br, workCh, 1024*1024, 10)
+	if err == nil {
+		t.Fatalf("expected an error for a block frame bigger than maxBlockSize")
+	}
+}